@@ -0,0 +1,216 @@
+// Copyright 2015 Factom Foundation
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package messages
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/FactomProject/factomd/common/interfaces"
+	"github.com/FactomProject/factomd/log"
+)
+
+// Topic names the channel a Signable is published on. Transports key their
+// subscriptions off of these rather than the Go type of the message, so a
+// TCP or libp2p transport can subscribe to "EOM" without importing this
+// package's concrete types.
+type Topic string
+
+const (
+	TopicEOM                     Topic = "EOM"
+	TopicDirectoryBlockSignature Topic = "DirectoryBlockSignature"
+)
+
+// Handler is invoked once per delivered message. Handlers run concurrently
+// with each other and must not block indefinitely; a slow handler holds one
+// of the run slots shared by every topic, so it can delay other handlers of
+// any topic, but never the publisher.
+type Handler func(Signable)
+
+// Broadcaster is the transport-agnostic fan-out that messages.* types use
+// to disseminate themselves, in place of writing directly to a single
+// network-out channel. In-process, TCP, and libp2p transports all implement
+// this the same way: Publish hands a message to every Subscribe-r of its
+// Topic, and dedup/throttling happen once, centrally, instead of per
+// transport.
+type Broadcaster interface {
+	// Publish fans a message out to every handler registered for topic. It
+	// does not block on slow handlers.
+	Publish(topic Topic, msg Signable)
+
+	// Subscribe registers handler for topic, returning an unsubscribe func.
+	Subscribe(topic Topic, handler Handler) (unsubscribe func())
+}
+
+// maxConcurrentHandlers bounds how many handlers localBroadcaster runs at
+// once, across all topics. Publish still starts one goroutine per handler
+// per message; goroutines waiting for a free slot are not bounded.
+const maxConcurrentHandlers = 32
+
+// localBroadcaster is the in-process Broadcaster used until a node wires up
+// a real transport (TCP, libp2p). It dedupes by GetHash() within a bounded
+// window and runs handlers on a semaphore-limited pool.
+type localBroadcaster struct {
+	mu       sync.RWMutex
+	handlers map[Topic][]Handler
+
+	seenMu sync.Mutex
+	seen   map[string]struct{}
+	order  []string
+
+	sem chan struct{}
+}
+
+// seenWindow is how many recent hashes localBroadcaster remembers for
+// dedup purposes before evicting the oldest.
+const seenWindow = 4096
+
+func newLocalBroadcaster() *localBroadcaster {
+	return &localBroadcaster{
+		handlers: make(map[Topic][]Handler),
+		seen:     make(map[string]struct{}),
+		sem:      make(chan struct{}, maxConcurrentHandlers),
+	}
+}
+
+func (b *localBroadcaster) Subscribe(topic Topic, handler Handler) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers[topic] = append(b.handlers[topic], handler)
+	idx := len(b.handlers[topic]) - 1
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		hs := b.handlers[topic]
+		if idx < len(hs) {
+			hs[idx] = nil
+		}
+	}
+}
+
+func (b *localBroadcaster) Publish(topic Topic, msg Signable) {
+	if b.duplicate(msg) {
+		return
+	}
+
+	b.mu.RLock()
+	handlers := append([]Handler(nil), b.handlers[topic]...)
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		if h == nil {
+			continue
+		}
+		h := h
+		// The semaphore is acquired inside the goroutine, not here, so a
+		// burst of slow/blocked handlers can only ever delay other
+		// goroutines spawned by Publish -- never Publish itself. Acquiring
+		// it before the go statement would make Publish block on whatever
+		// handler currently holds the last free slot, for any topic,
+		// breaking the non-blocking contract documented on Broadcaster.
+		go func() {
+			b.sem <- struct{}{}
+			defer func() { <-b.sem }()
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("messages: broadcaster handler for %s panicked: %v", topic, r)
+				}
+			}()
+			h(msg)
+		}()
+	}
+}
+
+// signerSetAware is implemented by messages whose GetHash() deliberately
+// excludes the data that distinguishes one partially-signed copy of the
+// message from another (an AggregateSignature's signed bytes can't include
+// the signature itself). Without this, two EOMs for the same minute/height/
+// identity but different signer subsets hash identically, and the second
+// one is dropped by duplicate() as a dup of the first before it ever gets a
+// chance to be merged (see EOM.MergeSignatures).
+type signerSetAware interface {
+	signerSetKey() string
+}
+
+func dedupKey(msg Signable) string {
+	key := fmt.Sprintf("%x", msg.GetHash().Bytes())
+	if sa, ok := msg.(signerSetAware); ok {
+		key += ":" + sa.signerSetKey()
+	}
+	return key
+}
+
+func (b *localBroadcaster) duplicate(msg Signable) bool {
+	key := dedupKey(msg)
+
+	b.seenMu.Lock()
+	defer b.seenMu.Unlock()
+
+	if _, ok := b.seen[key]; ok {
+		return true
+	}
+
+	b.seen[key] = struct{}{}
+	b.order = append(b.order, key)
+	if len(b.order) > seenWindow {
+		oldest := b.order[0]
+		b.order = b.order[1:]
+		delete(b.seen, oldest)
+	}
+	return false
+}
+
+// defaultBroadcaster is the process-wide Broadcaster used by messages.*
+// types until a transport registers a replacement via SetBroadcaster.
+var defaultBroadcaster Broadcaster = newLocalBroadcaster()
+
+// SetBroadcaster lets a transport (TCP listener, libp2p host, test harness)
+// install itself as the process-wide Broadcaster. It is expected to be
+// called once, during node startup, before any messages are published.
+func SetBroadcaster(b Broadcaster) {
+	defaultBroadcaster = b
+}
+
+// GetBroadcaster returns the process-wide Broadcaster in use.
+func GetBroadcaster() Broadcaster {
+	return defaultBroadcaster
+}
+
+// wiredStates tracks which interfaces.IState have already had their queues
+// subscribed to the default broadcaster, so a node running with no
+// transport installed still delivers messages the way it always did: onto
+// its own in/out queues.
+var wiredStates sync.Map // interfaces.IState -> struct{}
+
+// wireStateQueues subscribes state's NetworkOutMsgQueue/InMsgQueue to the
+// process-wide Broadcaster, once per state. This keeps single-node and
+// in-process-only deployments working unchanged while every other caller
+// goes through Publish/Subscribe like any other transport would.
+//
+// Only TopicDirectoryBlockSignature is wired here: it is the message this
+// queue replacement was introduced to replace. TopicEOM must not loop back
+// onto the state's own queues - EOM.FollowerExecute publishes on TopicEOM
+// while it is still processing the very message that would come back out
+// of InMsgQueue, which would run FollowerExecute a second time for the same
+// EOM. EventFeed subscribes to TopicEOM directly and does not go through
+// this function.
+func wireStateQueues(state interfaces.IState) {
+	if _, loaded := wiredStates.LoadOrStore(state, struct{}{}); loaded {
+		return
+	}
+
+	forward := func(msg Signable) {
+		imsg, ok := msg.(interfaces.IMsg)
+		if !ok {
+			return
+		}
+		state.NetworkOutMsgQueue() <- imsg
+		state.InMsgQueue() <- imsg
+	}
+
+	defaultBroadcaster.Subscribe(TopicDirectoryBlockSignature, forward)
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 Factom Foundation
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package messages
+
+import "fmt"
+
+// CanonAlg identifies which canonicalization layout MarshalForSignature
+// used to produce the bytes a signature covers, the way XML-DSig's
+// CanonicalizationMethod names the transform applied before signing.
+//
+// CanonV1 reproduces the pre-versioning byte layout exactly -- it does NOT
+// carry any alg marker in the signed bytes, so every signature and hash
+// computed before this scheme existed still verifies unchanged. Only
+// CanonV2 and later self-bind their algorithm ID into the signed bytes (as
+// their own first byte) to stop a signature made under a newer layout from
+// being replayed as if it were a plain CanonV1 one.
+type CanonAlg byte
+
+const (
+	// CanonV1 is the original field layout: Type, Timestamp, and whatever
+	// fields existed on the message before canonicalization versioning was
+	// introduced. It carries no marker of its own; a message is CanonV1
+	// unless its first byte matches a later algorithm's marker.
+	CanonV1 CanonAlg = 1
+
+	// CanonV2 is the layout for fields added after versioning was
+	// introduced. EOM's CanonV2 bytes are this marker followed by its
+	// CanonV1 bytes; its AggregateSignature is not part of the signed
+	// bytes. Its signed bytes begin with this marker value so it can be told
+	// apart from CanonV1 without any separate out-of-band framing. The
+	// value is chosen far outside the range any message.Type() constant
+	// is expected to occupy, since CanonV1 bytes begin with Type().
+	CanonV2 CanonAlg = 0xFE
+)
+
+// ErrUnknownCanonAlg is returned when a message's CanonAlg byte does not
+// match any registered canonicalization function. Callers must treat this
+// as "cannot verify", never as "valid" -- silently falling back to a
+// default algorithm would let an attacker pick whichever canonicalization
+// makes a forged signature verify.
+type ErrUnknownCanonAlg struct {
+	MsgType int
+	Alg     CanonAlg
+}
+
+func (e *ErrUnknownCanonAlg) Error() string {
+	return fmt.Sprintf("unknown canonicalization algorithm %d for message type %d", e.Alg, e.MsgType)
+}
+
+// canonFunc produces the complete canonical signing bytes for a message
+// under one algorithm, including that algorithm's own marker byte if it
+// has one (CanonV1 does not; CanonV2+ do -- see CanonAlg).
+type canonFunc func(Signable) ([]byte, error)
+
+var canonRegistry = map[int]map[CanonAlg]canonFunc{}
+
+// registerCanon adds fn as the canonicalization function for algorithm alg
+// on messages of type msgType, from an init() alongside the type's other
+// constructors. EOM is the only type that registers (CanonV1 and CanonV2);
+// canonicalize returns *ErrUnknownCanonAlg for every other message type.
+func registerCanon(msgType int, alg CanonAlg, fn canonFunc) {
+	algs, ok := canonRegistry[msgType]
+	if !ok {
+		algs = make(map[CanonAlg]canonFunc)
+		canonRegistry[msgType] = algs
+	}
+	algs[alg] = fn
+}
+
+// canonicalize looks up and runs the registered canonicalization function
+// for msgType/alg. It does not add any framing of its own -- each canonFunc
+// is responsible for its algorithm's own marker, if any.
+func canonicalize(msgType int, alg CanonAlg, msg Signable) ([]byte, error) {
+	algs, ok := canonRegistry[msgType]
+	if !ok {
+		return nil, &ErrUnknownCanonAlg{MsgType: msgType, Alg: alg}
+	}
+	fn, ok := algs[alg]
+	if !ok {
+		return nil, &ErrUnknownCanonAlg{MsgType: msgType, Alg: alg}
+	}
+	return fn(msg)
+}
@@ -8,6 +8,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"sync"
+
 	"github.com/FactomProject/factomd/common/constants"
 	"github.com/FactomProject/factomd/common/interfaces"
 	"github.com/FactomProject/factomd/common/primitives"
@@ -25,6 +27,19 @@ type EOM struct {
 
 	Signature interfaces.IFullSignature
 
+	// AggregateSignature, when present, carries a BLS aggregate over the
+	// identity chain IDs of every authority server that has signed this
+	// EOM, in place of (or in addition to) Signature. It lets followers
+	// fold several partially-signed EOMs together (see MergeSignatures)
+	// instead of re-gossiping one network message per signer.
+	AggregateSignature *primitives.AggregateSignature
+
+	// CanonAlg selects which canonicalization layout MarshalForSignature
+	// uses. The zero value is treated as CanonV1, or as CanonV2 when
+	// AggregateSignature is set (see effectiveCanonAlg), so existing callers
+	// that never set it keep signing/verifying exactly as before.
+	CanonAlg CanonAlg
+
 	//Not marshalled
 	hash interfaces.IHash
 }
@@ -32,6 +47,50 @@ type EOM struct {
 //var _ interfaces.IConfirmation = (*EOM)(nil)
 var _ Signable = (*EOM)(nil)
 
+func init() {
+	registerCanon(constants.EOM_MSG, CanonV1, eomCanonV1)
+	registerCanon(constants.EOM_MSG, CanonV2, eomCanonV2)
+}
+
+// eomCanonV1 is the original EOM signing layout: type, timestamp, minute,
+// directory block height, and identity chain ID.
+func eomCanonV1(msg Signable) ([]byte, error) {
+	m, ok := msg.(*EOM)
+	if !ok {
+		return nil, fmt.Errorf("eomCanonV1: not an EOM")
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{byte(m.Type())})
+	d, err := m.Timestamp.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(d)
+	binary.Write(&buf, binary.BigEndian, m.Minute)
+	binary.Write(&buf, binary.BigEndian, m.DirectoryBlockHeight)
+	hash, err := m.IdentityChainID.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(hash)
+
+	return buf.Bytes(), nil
+}
+
+// eomCanonV2 is CanonV1 plus room for fields added after canonicalization
+// versioning was introduced; EOM hasn't grown one yet, but registering it
+// now means the next field addition is a new canon func, not a silent
+// reinterpretation of CanonV1's bytes. It leads with the CanonV2 marker
+// byte so it can never be mistaken for (or replayed as) a CanonV1 message.
+func eomCanonV2(msg Signable) ([]byte, error) {
+	body, err := eomCanonV1(msg)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(CanonV2)}, body...), nil
+}
+
 func (e *EOM) Process(interfaces.IState) {
 
 }
@@ -47,6 +106,18 @@ func (m *EOM) GetHash() interfaces.IHash {
 	return m.hash
 }
 
+// signerSetKey implements signerSetAware: GetHash() covers only the fields
+// MarshalForSignature signs, which by design excludes AggregateSignature
+// itself, so two EOMs carrying different signer subsets for the same
+// minute/height/identity would otherwise hash identically and the
+// broadcaster would drop every partial signature but the first one it saw.
+func (m *EOM) signerSetKey() string {
+	if m.AggregateSignature == nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", m.AggregateSignature.Bitmap)
+}
+
 func (m *EOM) GetTimestamp() interfaces.Timestamp {
 	return m.Timestamp
 }
@@ -60,25 +131,55 @@ func (m *EOM) Bytes() []byte {
 	return append(ret, m.Minute)
 }
 
+// UnmarshalBinaryData parses data into m. Every read is bounds-checked up
+// front rather than relying on recover() to turn an out-of-range slice
+// index into an error; a truncated message now returns a typed
+// *ErrTruncated instead of silently succeeding on whatever bytes happen to
+// be present.
+//
+// There is no separate, always-present CanonAlg envelope byte: a CanonV1
+// message is byte-for-byte what this type has always put on the wire
+// (Type first), so pre-versioning peers and historical signatures keep
+// working unchanged. A CanonV2+ message is told apart by its own
+// self-binding marker (see CanonAlg) in the position Type would otherwise
+// occupy.
 func (m *EOM) UnmarshalBinaryData(data []byte) (newData []byte, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = fmt.Errorf("Error unmarshalling: %v", r)
-		}
-	}()
-	newData = data[1:]
+	if len(data) < 1 {
+		return nil, &ErrTruncated{Where: "EOM.Type", Need: 1, Have: 0}
+	}
+	if CanonAlg(data[0]) == CanonV2 {
+		m.CanonAlg = CanonV2
+		newData = data[1:]
+	} else {
+		m.CanonAlg = CanonV1
+		newData = data
+	}
+
+	if len(newData) < 1 {
+		return nil, &ErrTruncated{Where: "EOM.Type", Need: 1, Have: 0}
+	}
+	if int(newData[0]) != constants.EOM_MSG {
+		return nil, &ErrUnknownType{Type: int(newData[0])}
+	}
+	newData = newData[1:] // skip the message type byte
 
 	newData, err = m.Timestamp.UnmarshalBinaryData(newData)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(newData) < 1 {
+		return nil, &ErrTruncated{Where: "EOM.Minute", Need: 1, Have: 0}
+	}
 	m.Minute, newData = newData[0], newData[1:]
 
-	if m.Minute < 0 || m.Minute >= 10 {
-		return nil, fmt.Errorf("Minute number is out of range")
+	if m.Minute >= 10 {
+		return nil, &ErrInvalidMinute{Minute: m.Minute}
 	}
 
+	if len(newData) < 4 {
+		return nil, &ErrTruncated{Where: "EOM.DirectoryBlockHeight", Need: 4, Have: len(newData)}
+	}
 	m.DirectoryBlockHeight, newData = binary.BigEndian.Uint32(newData[0:4]), newData[4:]
 
 	hash := new(primitives.Hash)
@@ -88,15 +189,53 @@ func (m *EOM) UnmarshalBinaryData(data []byte) (newData []byte, err error) {
 	}
 	m.IdentityChainID = hash
 
-	if len(newData) > 0 {
+	if m.CanonAlg == CanonV1 {
+		// CanonV1's tail is exactly the original format: a legacy
+		// Signature if any bytes remain, nothing otherwise.
+		// AggregateSignature isn't representable here -- that capability
+		// didn't exist when CanonV1 was the only layout, so a CanonV1
+		// message never carries one.
+		if len(newData) > 0 {
+			sig := new(primitives.Signature)
+			newData, err = sig.UnmarshalBinaryData(newData)
+			if err != nil {
+				return nil, &ErrBadSignature{Reason: err.Error()}
+			}
+			m.Signature = sig
+		}
+		return data, nil
+	}
+
+	// CanonV2+: both the legacy Signature and the newer AggregateSignature
+	// are new wire territory, so each is framed with an explicit presence
+	// flag rather than inferred from "bytes remain" -- a message can
+	// legitimately carry an AggregateSignature with no legacy Signature.
+	if len(newData) < 1 {
+		return nil, &ErrTruncated{Where: "EOM.hasSignature flag", Need: 1, Have: 0}
+	}
+	hasSig, newData := newData[0], newData[1:]
+	if hasSig == 1 {
 		sig := new(primitives.Signature)
 		newData, err = sig.UnmarshalBinaryData(newData)
 		if err != nil {
-			return nil, err
+			return nil, &ErrBadSignature{Reason: err.Error()}
 		}
 		m.Signature = sig
 	}
 
+	if len(newData) < 1 {
+		return nil, &ErrTruncated{Where: "EOM.hasAggregateSignature flag", Need: 1, Have: 0}
+	}
+	hasAgg, newData := newData[0], newData[1:]
+	if hasAgg == 1 {
+		agg := new(primitives.AggregateSignature)
+		newData, err = agg.UnmarshalBinaryData(newData)
+		if err != nil {
+			return nil, &ErrBadSignature{Reason: err.Error()}
+		}
+		m.AggregateSignature = agg
+	}
+
 	return data, nil
 }
 
@@ -105,39 +244,71 @@ func (m *EOM) UnmarshalBinary(data []byte) error {
 	return err
 }
 
-func (m *EOM) MarshalForSignature() (data []byte, err error) {
-	var buf bytes.Buffer
-	buf.Write([]byte{byte(m.Type())})
-	if d, err := m.Timestamp.MarshalBinary(); err != nil {
-		return nil, err
-	} else {
-		buf.Write(d)
+// effectiveCanonAlg resolves which CanonAlg actually governs m: its
+// explicit CanonAlg if one has been set, else CanonV2 as soon as it
+// carries an AggregateSignature (a capability CanonV1 predates), else
+// CanonV1.
+func (m *EOM) effectiveCanonAlg() CanonAlg {
+	if m.CanonAlg != 0 {
+		return m.CanonAlg
 	}
-	binary.Write(&buf, binary.BigEndian, m.Minute)
-	binary.Write(&buf, binary.BigEndian, m.DirectoryBlockHeight)
-	hash, err := m.IdentityChainID.MarshalBinary()
-	if err != nil {
-		return nil, err
+	if m.AggregateSignature != nil {
+		return CanonV2
 	}
-	buf.Write(hash)
+	return CanonV1
+}
 
-	return buf.Bytes(), nil
+// MarshalForSignature returns the bytes VerifySignature covers, laid out
+// according to m.effectiveCanonAlg(). CanonV1's bytes are exactly the
+// pre-versioning layout (Type, Timestamp, Minute, DirectoryBlockHeight,
+// IdentityChainID) with no alg marker, so every signature and hash
+// computed before CanonAlg existed still verifies unchanged.
+func (m *EOM) MarshalForSignature() (data []byte, err error) {
+	return canonicalize(m.Type(), m.effectiveCanonAlg(), m)
 }
 
 func (m *EOM) MarshalBinary() (data []byte, err error) {
+	alg := m.effectiveCanonAlg()
 	resp, err := m.MarshalForSignature()
 	if err != nil {
 		return nil, err
 	}
-	sig := m.GetSignature()
 
+	if alg == CanonV1 {
+		sig := m.GetSignature()
+		if sig != nil {
+			sigBytes, err := sig.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			resp = append(resp, sigBytes...)
+		}
+		return resp, nil
+	}
+
+	sig := m.GetSignature()
 	if sig != nil {
 		sigBytes, err := sig.MarshalBinary()
 		if err != nil {
 			return nil, err
 		}
-		return append(resp, sigBytes...), nil
+		resp = append(resp, 1)
+		resp = append(resp, sigBytes...)
+	} else {
+		resp = append(resp, 0)
 	}
+
+	if m.AggregateSignature != nil {
+		aggBytes, err := m.AggregateSignature.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		resp = append(resp, 1)
+		resp = append(resp, aggBytes...)
+	} else {
+		resp = append(resp, 0)
+	}
+
 	return resp, nil
 }
 
@@ -149,12 +320,51 @@ func (m *EOM) Type() int {
 	return constants.EOM_MSG
 }
 
+// ValidateErr re-checks m's own fields and signature, returning a concrete
+// error type so higher layers can distinguish "malformed, drop peer"
+// (ErrInvalidMinute, ErrBadSignature) from other failure modes, instead of
+// pattern matching on Validate's -1/0/1.
+func (m *EOM) ValidateErr(state interfaces.IState) error {
+	if m.Minute >= 10 {
+		return &ErrInvalidMinute{Minute: m.Minute}
+	}
+	if m.IdentityChainID == nil {
+		return &ErrTruncated{Where: "EOM.IdentityChainID", Need: 1, Have: 0}
+	}
+	if m.Signature == nil && m.AggregateSignature == nil {
+		return &ErrUnverifiable{Reason: "no signature present"}
+	}
+
+	ok, err := m.VerifySignature(state.GetNetworkNumber())
+	if err != nil {
+		// VerifySignature itself failed to run a check (e.g. no authority
+		// key provider installed yet) rather than running one and failing
+		// it -- that's "can't tell yet", not "provably bad".
+		return &ErrUnverifiable{Reason: err.Error()}
+	}
+	if !ok {
+		return &ErrBadSignature{Reason: "signature does not verify"}
+	}
+	return nil
+}
+
 // Validate the message, given the state.  Three possible results:
 //  < 0 -- Message is invalid.  Discard
 //  0   -- Cannot tell if message is Valid
 //  1   -- Message is valid
-func (m *EOM) Validate(interfaces.IState) int {
-	return 1
+//
+// Backed by ValidateErr so this int contract and the typed-error API can't
+// drift apart; callers that need to distinguish *why* a message is invalid
+// should call ValidateErr directly.
+func (m *EOM) Validate(state interfaces.IState) int {
+	switch m.ValidateErr(state).(type) {
+	case nil:
+		return 1
+	case *ErrUnverifiable:
+		return 0
+	default:
+		return -1
+	}
 }
 
 // Returns true if this is a message for this server to execute as
@@ -169,8 +379,8 @@ func (m *EOM) LeaderExecute(state interfaces.IState) error {
 	DBM := NewDirectoryBlockSignature()
 	DBM.DirectoryBlockKeyMR = state.GetPreviousDirectoryBlock().GetKeyMR()
 	DBM.Sign(state)
-	state.NetworkOutMsgQueue() <- DBM
-	state.InMsgQueue() <- DBM
+	wireStateQueues(state)
+	GetBroadcaster().Publish(TopicDirectoryBlockSignature, DBM)
 
 	return nil
 }
@@ -190,11 +400,23 @@ func (m *EOM) FollowerExecute(state interfaces.IState) error {
 
 	state.GetFactoidState().EndOfPeriod(int(m.Minute))
 
+	// Fold m's signer(s) into the most complete partial EOM already seen
+	// for this minute/height/identity, if any, so the network converges on
+	// one re-gossiped message per minute instead of one per signer (see
+	// MergeSignatures).
+	m = m.mergeWithSeenPartial()
+
+	// Publish the minute transition itself so anyone watching via an
+	// EventFeed (block explorers, wallet watchers) sees it without having
+	// to infer it from the DirectoryBlockSignature that may or may not
+	// follow.
+	GetBroadcaster().Publish(TopicEOM, m)
+
 	switch state.GetNetworkNumber() {
 	case constants.NETWORK_MAIN: // Main Network
-		panic("Not implemented yet")
+		m.rollForwardAndSign(state, constants.NETWORK_MAIN)
 	case constants.NETWORK_TEST: // Test Network
-		panic("Not implemented yet")
+		m.rollForwardAndSign(state, constants.NETWORK_TEST)
 	case constants.NETWORK_LOCAL: // Local Network
 
 	default:
@@ -213,6 +435,27 @@ func (m *EOM) FollowerExecute(state interfaces.IState) error {
 	return nil
 }
 
+// rollForwardAndSign advances the directory block anchors/chain heads for a
+// real (non-local) network at this minute boundary, and broadcasts a
+// DirectoryBlockSignature if, and only if, this node currently holds a seat
+// in that network's authority set. Every follower runs the anchor roll
+// forward so their local state stays in lock step, but only authority
+// servers should be producing signatures -- otherwise every follower node
+// would flood the network with a signature nobody asked it to make.
+func (m *EOM) rollForwardAndSign(state interfaces.IState, networkID int) {
+	dBlockAnchorRollForwardFn(state, networkID, m.DirectoryBlockHeight)
+
+	if !inAuthoritySetFn(state, networkID) {
+		return
+	}
+
+	DBM := NewDirectoryBlockSignature()
+	DBM.DirectoryBlockKeyMR = state.GetPreviousDirectoryBlock().GetKeyMR()
+	DBM.Sign(state)
+	wireStateQueues(state)
+	GetBroadcaster().Publish(TopicDirectoryBlockSignature, DBM)
+}
+
 func (e *EOM) JSONByte() ([]byte, error) {
 	return primitives.EncodeJSON(e)
 }
@@ -238,10 +481,160 @@ func (m *EOM) GetSignature() interfaces.IFullSignature {
 	return m.Signature
 }
 
-func (m *EOM) VerifySignature() (bool, error) {
+// VerifySignature accepts either a legacy single signature or an
+// AggregateSignature; an EOM should never carry a verifiable signature of
+// both kinds, but if it carries an aggregate only the aggregate is checked
+// (the legacy Signature is not tried), since that's the form a federated
+// network converges on.
+// networkID selects which network's authority set to verify an
+// AggregateSignature against, the same constants.NETWORK_MAIN/TEST
+// convention used by DBlockAnchorRollForwardFunc and InAuthoritySetFunc.
+func (m *EOM) VerifySignature(networkID int) (bool, error) {
+	if m.AggregateSignature != nil {
+		pubkeys, err := authoritySetPublicKeys(networkID)
+		if err != nil {
+			return false, err
+		}
+		data, err := m.MarshalForSignature()
+		if err != nil {
+			return false, err
+		}
+		return m.AggregateSignature.VerifyAggregate(pubkeys, data)
+	}
 	return VerifyMessage(m)
 }
 
+// MergeSignatures folds other's partial signature(s) into m, so two EOMs
+// signed by disjoint subsets of the authority set can be re-gossiped as a
+// single, more-complete message instead of two. Both EOMs must otherwise be
+// identical (same minute, height, and identity chain ID) or the merge is
+// refused as meaningless.
+func (m *EOM) MergeSignatures(other *EOM) error {
+	if other == nil {
+		return fmt.Errorf("cannot merge a nil EOM")
+	}
+	if m.Minute != other.Minute || m.DirectoryBlockHeight != other.DirectoryBlockHeight ||
+		!m.IdentityChainID.IsSameAs(other.IdentityChainID) {
+		return fmt.Errorf("cannot merge EOMs for different minutes/heights/identities")
+	}
+
+	switch {
+	case other.AggregateSignature == nil:
+		return nil
+	case m.AggregateSignature == nil:
+		m.AggregateSignature = other.AggregateSignature
+		return nil
+	default:
+		return m.AggregateSignature.Merge(other.AggregateSignature)
+	}
+}
+
+// partialEOMs tracks the most complete AggregateSignature-bearing EOM
+// FollowerExecute has folded together so far for each (minute, height,
+// identity), so the next partially-signed EOM received for the same triple
+// can be merged against it instead of re-gossiped as a separate message.
+// Keyed by string rather than the EOM itself, since two EOMs differing only
+// in signer set must resolve to the same entry.
+var partialEOMs sync.Map // string -> *EOM
+
+func partialEOMKey(m *EOM) string {
+	return fmt.Sprintf("%d:%d:%x", m.Minute, m.DirectoryBlockHeight, m.IdentityChainID.Bytes())
+}
+
+// cloneEOM returns a copy of src safe to mutate via MergeSignatures without
+// aliasing src's AggregateSignature.Bitmap -- src may still be the value
+// stored in partialEOMs and read by another goroutine.
+func cloneEOM(src *EOM) *EOM {
+	clone := *src
+	clone.hash = nil
+	if src.AggregateSignature != nil {
+		agg := *src.AggregateSignature
+		agg.Bitmap = append([]byte(nil), src.AggregateSignature.Bitmap...)
+		clone.AggregateSignature = &agg
+	}
+	return &clone
+}
+
+// mergeWithSeenPartial folds m into the most complete partial EOM already
+// recorded for m's (minute, height, identity), records the result as the new
+// most-complete partial, and returns it. An m with no AggregateSignature at
+// all is returned unchanged -- there is nothing to fold or track. If the
+// merge itself fails (e.g. an overlapping signer, which should never happen
+// for two honestly-produced partials), m is published as-is rather than
+// dropped.
+func (m *EOM) mergeWithSeenPartial() *EOM {
+	if m.AggregateSignature == nil {
+		return m
+	}
+
+	key := partialEOMKey(m)
+	prev, loaded := partialEOMs.Load(key)
+	if !loaded {
+		partialEOMs.Store(key, m)
+		return m
+	}
+
+	merged := cloneEOM(prev.(*EOM))
+	if err := merged.MergeSignatures(m); err != nil {
+		log.Printf("messages: EOM.MergeSignatures failed for %s: %v", key, err)
+		return m
+	}
+	partialEOMs.Store(key, merged)
+	return merged
+}
+
+// DBlockAnchorRollForwardFunc advances state's directory block anchors/chain
+// heads to height for networkID. The state layer installs the real
+// implementation at startup; until then this is a no-op so a node with no
+// provider installed simply doesn't roll forward rather than failing to
+// compile or panicking.
+type DBlockAnchorRollForwardFunc func(state interfaces.IState, networkID int, height uint32)
+
+var dBlockAnchorRollForwardFn DBlockAnchorRollForwardFunc = func(interfaces.IState, int, uint32) {}
+
+// SetDBlockAnchorRollForwardFunc installs the provider used to roll forward
+// directory block anchors on each EOM.
+func SetDBlockAnchorRollForwardFunc(f DBlockAnchorRollForwardFunc) {
+	dBlockAnchorRollForwardFn = f
+}
+
+// InAuthoritySetFunc reports whether state's own identity currently holds a
+// seat in networkID's authority set. It takes state rather than an identity
+// chain ID specifically so callers can't accidentally ask "is the sender an
+// authority" when they mean "am I" -- only state's own membership is ever in
+// scope. The state/identity layer installs the real implementation at
+// startup; until then this conservatively reports false so no unconfigured
+// node starts producing signatures it has no business producing.
+type InAuthoritySetFunc func(state interfaces.IState, networkID int) bool
+
+var inAuthoritySetFn InAuthoritySetFunc = func(interfaces.IState, int) bool { return false }
+
+// SetInAuthoritySetFunc installs the provider used to decide whether this
+// node should sign and broadcast a DirectoryBlockSignature at each EOM.
+func SetInAuthoritySetFunc(f InAuthoritySetFunc) {
+	inAuthoritySetFn = f
+}
+
+// AuthorityPublicKeysFunc resolves the BLS public keys of networkID's
+// current authority set, in the same order the authority set's bitmap
+// indices were assigned. The state/identity layer installs the real
+// implementation at startup; tests may install their own.
+type AuthorityPublicKeysFunc func(networkID int) ([]*primitives.BLSPublicKey, error)
+
+var authoritySetPublicKeysFn AuthorityPublicKeysFunc = func(int) ([]*primitives.BLSPublicKey, error) {
+	return nil, fmt.Errorf("no authority set public key provider has been installed")
+}
+
+// SetAuthorityPublicKeysFunc installs the provider used to resolve
+// authority set public keys for AggregateSignature verification.
+func SetAuthorityPublicKeysFunc(f AuthorityPublicKeysFunc) {
+	authoritySetPublicKeysFn = f
+}
+
+func authoritySetPublicKeys(networkID int) ([]*primitives.BLSPublicKey, error) {
+	return authoritySetPublicKeysFn(networkID)
+}
+
 /**********************************************************************
  * Support
  **********************************************************************/
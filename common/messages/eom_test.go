@@ -0,0 +1,355 @@
+// Copyright 2015 Factom Foundation
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package messages
+
+import (
+	"testing"
+
+	"github.com/FactomProject/factomd/common/constants"
+	"github.com/FactomProject/factomd/common/interfaces"
+	"github.com/FactomProject/factomd/common/primitives"
+	bls "github.com/herumi/bls-eth-go-binary/bls"
+)
+
+// fakeState embeds interfaces.IState so it satisfies the interface through
+// promoted (nil, panic-on-call) methods, and only overrides the handful
+// FollowerExecute/rollForwardAndSign actually touch along the paths these
+// tests exercise. Paths that would need a working DirectoryBlockSignature
+// (the authority-set-true branch of rollForwardAndSign) are deliberately
+// not exercised here -- that type isn't under test by this file.
+type fakeState struct {
+	interfaces.IState
+
+	processList   [][]interfaces.IMsg
+	factoidState  fakeFactoidState
+	networkNumber int
+}
+
+func newFakeState(networkNumber int) *fakeState {
+	return &fakeState{
+		processList:   [][]interfaces.IMsg{{}},
+		networkNumber: networkNumber,
+	}
+}
+
+func (s *fakeState) GetProcessList() [][]interfaces.IMsg       { return s.processList }
+func (s *fakeState) GetFactoidState() interfaces.IFactoidState { return &s.factoidState }
+func (s *fakeState) GetNetworkNumber() int                     { return s.networkNumber }
+
+type fakeFactoidState struct {
+	interfaces.IFactoidState
+
+	minutesEnded []int
+}
+
+func (f *fakeFactoidState) EndOfPeriod(minute int) {
+	f.minutesEnded = append(f.minutesEnded, minute)
+}
+
+func withMockedRollForwardHooks(t *testing.T, inAuthoritySet bool) (rolledForward []int) {
+	t.Helper()
+
+	prevRollForward := dBlockAnchorRollForwardFn
+	prevInAuthority := inAuthoritySetFn
+	t.Cleanup(func() {
+		dBlockAnchorRollForwardFn = prevRollForward
+		inAuthoritySetFn = prevInAuthority
+	})
+
+	SetDBlockAnchorRollForwardFunc(func(state interfaces.IState, networkID int, height uint32) {
+		rolledForward = append(rolledForward, networkID)
+	})
+	SetInAuthoritySetFunc(func(interfaces.IState, int) bool { return inAuthoritySet })
+
+	return rolledForward
+}
+
+// TestEOMFollowerExecuteRollsForwardOnMainAndTest covers the MAIN/TEST
+// branches of FollowerExecute's network switch: both should roll the
+// directory block anchor forward for their own constants.NETWORK_* value,
+// and neither should attempt to emit a signature while this node has no
+// seat in the authority set.
+func TestEOMFollowerExecuteRollsForwardOnMainAndTest(t *testing.T) {
+	cases := []struct {
+		name    string
+		network int
+	}{
+		{"Main", constants.NETWORK_MAIN},
+		{"Test", constants.NETWORK_TEST},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rolledForward := withMockedRollForwardHooks(t, false)
+
+			state := newFakeState(c.network)
+			m := &EOM{Minute: 3, IdentityChainID: primitives.Sha([]byte("identity chain"))}
+
+			if err := m.FollowerExecute(state); err != nil {
+				t.Fatalf("FollowerExecute: %v", err)
+			}
+
+			if len(rolledForward) != 1 || rolledForward[0] != c.network {
+				t.Errorf("rolled forward = %v, want exactly one call for network %d", rolledForward, c.network)
+			}
+			if len(state.factoidState.minutesEnded) != 1 || state.factoidState.minutesEnded[0] != 3 {
+				t.Errorf("EndOfPeriod calls = %v, want [3]", state.factoidState.minutesEnded)
+			}
+		})
+	}
+}
+
+// TestEOMFollowerExecuteLocalNetworkSkipsRollForward covers the LOCAL
+// network case, which intentionally does nothing with the directory block
+// anchor -- a local/sim network has no real directory block chain to anchor.
+func TestEOMFollowerExecuteLocalNetworkSkipsRollForward(t *testing.T) {
+	rolledForward := withMockedRollForwardHooks(t, false)
+
+	state := newFakeState(constants.NETWORK_LOCAL)
+	m := &EOM{Minute: 3, IdentityChainID: primitives.Sha([]byte("identity chain"))}
+
+	if err := m.FollowerExecute(state); err != nil {
+		t.Fatalf("FollowerExecute: %v", err)
+	}
+	if len(rolledForward) != 0 {
+		t.Errorf("rolled forward = %v, want no calls on the local network", rolledForward)
+	}
+}
+
+// TestEOMFollowerExecutePanicsOnUnknownNetwork covers the default case of
+// FollowerExecute's network switch: an unrecognized network number is a
+// configuration error, not something to silently ignore.
+func TestEOMFollowerExecutePanicsOnUnknownNetwork(t *testing.T) {
+	withMockedRollForwardHooks(t, false)
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("FollowerExecute should panic on an unrecognized network number")
+		}
+	}()
+
+	state := newFakeState(99)
+	m := &EOM{Minute: 3, IdentityChainID: primitives.Sha([]byte("identity chain"))}
+	m.FollowerExecute(state)
+}
+
+// TestEOMRollForwardAndSignGatesSignatureOnAuthoritySet covers
+// rollForwardAndSign's authority gate: every follower rolls the anchor
+// forward regardless, but only a node with a seat in the authority set goes
+// on to build and broadcast a signature.
+func TestEOMRollForwardAndSignGatesSignatureOnAuthoritySet(t *testing.T) {
+	rolledForward := withMockedRollForwardHooks(t, false)
+
+	m := &EOM{Minute: 5, DirectoryBlockHeight: 42}
+	m.rollForwardAndSign(nil, constants.NETWORK_MAIN)
+
+	if len(rolledForward) != 1 || rolledForward[0] != constants.NETWORK_MAIN {
+		t.Errorf("rolled forward = %v, want exactly one call for NETWORK_MAIN", rolledForward)
+	}
+	// inAuthoritySetFn is forced false above, so rollForwardAndSign must
+	// return before touching state (nil) to build a DirectoryBlockSignature
+	// -- reaching that code with a nil state would panic.
+}
+
+func testEOM(minute byte, height uint32, identity interfaces.IHash) *EOM {
+	return &EOM{
+		Timestamp:            primitives.NewTimestampNow(),
+		Minute:               minute,
+		DirectoryBlockHeight: height,
+		IdentityChainID:      identity,
+	}
+}
+
+// TestEOMMarshalForSignatureCanonV2RoundTrip covers MarshalForSignature and
+// UnmarshalBinaryData under CanonV2, including an AggregateSignature, which
+// CanonV1 predates and cannot represent.
+func TestEOMMarshalForSignatureCanonV2RoundTrip(t *testing.T) {
+	identity := primitives.Sha([]byte("identity chain"))
+
+	m := testEOM(7, 123, identity)
+	m.AggregateSignature = &primitives.AggregateSignature{Bitmap: []byte{0x05}}
+
+	if m.effectiveCanonAlg() != CanonV2 {
+		t.Fatalf("effectiveCanonAlg() = %v, want CanonV2 once an AggregateSignature is present", m.effectiveCanonAlg())
+	}
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	got := new(EOM)
+	if _, err := got.UnmarshalBinaryData(data); err != nil {
+		t.Fatalf("UnmarshalBinaryData: %v", err)
+	}
+
+	if got.CanonAlg != CanonV2 {
+		t.Errorf("CanonAlg = %v, want CanonV2", got.CanonAlg)
+	}
+	if got.Minute != m.Minute || got.DirectoryBlockHeight != m.DirectoryBlockHeight {
+		t.Errorf("Minute/DirectoryBlockHeight = %d/%d, want %d/%d", got.Minute, got.DirectoryBlockHeight, m.Minute, m.DirectoryBlockHeight)
+	}
+	if !got.IdentityChainID.IsSameAs(identity) {
+		t.Errorf("IdentityChainID = %x, want %x", got.IdentityChainID.Bytes(), identity.Bytes())
+	}
+	if got.AggregateSignature == nil || got.AggregateSignature.Bitmap[0] != 0x05 {
+		t.Errorf("AggregateSignature = %+v, want Bitmap [0x05]", got.AggregateSignature)
+	}
+}
+
+// TestEOMValidateErrMapsToValidateResult covers Validate's -1/0/1 contract
+// against the concrete error types ValidateErr can return.
+func TestEOMValidateErrMapsToValidateResult(t *testing.T) {
+	identity := primitives.Sha([]byte("identity chain"))
+
+	t.Run("ErrInvalidMinute maps to -1", func(t *testing.T) {
+		m := testEOM(12, 1, identity)
+		if _, ok := m.ValidateErr(newFakeState(constants.NETWORK_MAIN)).(*ErrInvalidMinute); !ok {
+			t.Fatalf("ValidateErr = %T, want *ErrInvalidMinute", m.ValidateErr(newFakeState(constants.NETWORK_MAIN)))
+		}
+		if got := m.Validate(newFakeState(constants.NETWORK_MAIN)); got != -1 {
+			t.Errorf("Validate() = %d, want -1 (invalid)", got)
+		}
+	})
+
+	t.Run("no signature maps to ErrUnverifiable and 0", func(t *testing.T) {
+		m := testEOM(3, 1, identity)
+		if _, ok := m.ValidateErr(newFakeState(constants.NETWORK_MAIN)).(*ErrUnverifiable); !ok {
+			t.Fatalf("ValidateErr = %T, want *ErrUnverifiable", m.ValidateErr(newFakeState(constants.NETWORK_MAIN)))
+		}
+		if got := m.Validate(newFakeState(constants.NETWORK_MAIN)); got != 0 {
+			t.Errorf("Validate() = %d, want 0 (cannot tell)", got)
+		}
+	})
+
+	t.Run("no authority key provider maps to ErrUnverifiable and 0", func(t *testing.T) {
+		m := testEOM(3, 1, identity)
+		m.AggregateSignature = &primitives.AggregateSignature{Bitmap: []byte{0x01}}
+		// No SetAuthorityPublicKeysFunc installed in this test: the default
+		// provider always errors, which VerifySignature surfaces as
+		// ErrUnverifiable rather than ErrBadSignature -- "can't check yet",
+		// not "checked and failed".
+		if _, ok := m.ValidateErr(newFakeState(constants.NETWORK_MAIN)).(*ErrUnverifiable); !ok {
+			t.Fatalf("ValidateErr = %T, want *ErrUnverifiable", m.ValidateErr(newFakeState(constants.NETWORK_MAIN)))
+		}
+		if got := m.Validate(newFakeState(constants.NETWORK_MAIN)); got != 0 {
+			t.Errorf("Validate() = %d, want 0 (cannot tell)", got)
+		}
+	})
+
+	t.Run("failed aggregate verification maps to ErrBadSignature and -1", func(t *testing.T) {
+		prev := authoritySetPublicKeysFn
+		t.Cleanup(func() { authoritySetPublicKeysFn = prev })
+
+		var sk bls.SecretKey
+		sk.SetByCSPRNG()
+		pk := sk.GetPublicKey()
+		SetAuthorityPublicKeysFunc(func(int) ([]*primitives.BLSPublicKey, error) {
+			return []*primitives.BLSPublicKey{primitives.NewBLSPublicKey(pk)}, nil
+		})
+
+		m := testEOM(3, 1, identity)
+		// A genuine signature, but over the wrong message: VerifyAggregate
+		// should run to completion and report false, not error out --
+		// that's the ok=false/err=nil case ValidateErr maps to
+		// ErrBadSignature rather than ErrUnverifiable.
+		sig := sk.SignByte([]byte("not the message this EOM actually signs"))
+		agg := primitives.NewAggregateSignature(1)
+		if err := agg.Add(0, primitives.NewBLSPublicKey(pk), sig); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+		m.AggregateSignature = agg
+
+		if _, ok := m.ValidateErr(newFakeState(constants.NETWORK_MAIN)).(*ErrBadSignature); !ok {
+			t.Fatalf("ValidateErr = %T, want *ErrBadSignature", m.ValidateErr(newFakeState(constants.NETWORK_MAIN)))
+		}
+		if got := m.Validate(newFakeState(constants.NETWORK_MAIN)); got != -1 {
+			t.Errorf("Validate() = %d, want -1 (invalid)", got)
+		}
+	})
+}
+
+// TestEOMMergeSignaturesFoldsDisjointPartials covers EOM.MergeSignatures
+// itself, not just the lower-level AggregateSignature.Merge it delegates
+// to -- folding two EOMs signed by disjoint authority subsets for the same
+// minute/height/identity should yield the union of both signer bitmaps.
+func TestEOMMergeSignaturesFoldsDisjointPartials(t *testing.T) {
+	identity := primitives.Sha([]byte("identity chain"))
+
+	a := testEOM(3, 1, identity)
+	a.AggregateSignature = &primitives.AggregateSignature{Bitmap: []byte{0x01}}
+
+	b := testEOM(3, 1, identity)
+	b.AggregateSignature = &primitives.AggregateSignature{Bitmap: []byte{0x02}}
+
+	if err := a.MergeSignatures(b); err != nil {
+		t.Fatalf("MergeSignatures: %v", err)
+	}
+	if a.AggregateSignature.Bitmap[0] != 0x03 {
+		t.Errorf("Bitmap = %x, want %x (union of both signers)", a.AggregateSignature.Bitmap, byte(0x03))
+	}
+}
+
+// TestEOMMergeSignaturesRejectsDifferentMinute covers MergeSignatures'
+// own identity check, above and beyond what AggregateSignature.Merge
+// checks: two EOMs for different minutes must never be folded together,
+// no matter what their signer bitmaps look like.
+func TestEOMMergeSignaturesRejectsDifferentMinute(t *testing.T) {
+	identity := primitives.Sha([]byte("identity chain"))
+
+	a := testEOM(3, 1, identity)
+	a.AggregateSignature = &primitives.AggregateSignature{Bitmap: []byte{0x01}}
+
+	b := testEOM(4, 1, identity)
+	b.AggregateSignature = &primitives.AggregateSignature{Bitmap: []byte{0x02}}
+
+	if err := a.MergeSignatures(b); err == nil {
+		t.Fatal("MergeSignatures should reject EOMs for different minutes")
+	}
+}
+
+func TestEOMMergeSignaturesRejectsNilOther(t *testing.T) {
+	a := testEOM(3, 1, primitives.Sha([]byte("identity chain")))
+	a.AggregateSignature = &primitives.AggregateSignature{Bitmap: []byte{0x01}}
+
+	if err := a.MergeSignatures(nil); err == nil {
+		t.Fatal("MergeSignatures should reject a nil other EOM")
+	}
+}
+
+// TestEOMMergeWithSeenPartialMergesAcrossCalls covers the FollowerExecute
+// integration point itself: a second partially-signed EOM for the same
+// minute/height/identity should be folded into the first rather than
+// tracked (or published) as an unrelated message.
+func TestEOMMergeWithSeenPartialMergesAcrossCalls(t *testing.T) {
+	identity := primitives.Sha([]byte("identity chain"))
+
+	first := testEOM(6, 9, identity)
+	first.AggregateSignature = &primitives.AggregateSignature{Bitmap: []byte{0x01}}
+	key := partialEOMKey(first)
+	t.Cleanup(func() { partialEOMs.Delete(key) })
+
+	gotFirst := first.mergeWithSeenPartial()
+	if gotFirst != first {
+		t.Fatal("mergeWithSeenPartial should return the original EOM when no partial was seen yet")
+	}
+
+	second := testEOM(6, 9, identity)
+	second.AggregateSignature = &primitives.AggregateSignature{Bitmap: []byte{0x02}}
+
+	merged := second.mergeWithSeenPartial()
+	if merged == second {
+		t.Fatal("mergeWithSeenPartial should return a merged copy, not the raw second partial")
+	}
+	if merged.AggregateSignature.Bitmap[0] != 0x03 {
+		t.Errorf("Bitmap = %x, want %x (union of both signers)", merged.AggregateSignature.Bitmap, byte(0x03))
+	}
+	// The stored partial (and the original `first`) must not have been
+	// mutated in place -- mergeWithSeenPartial clones before merging so a
+	// concurrent reader of the map never observes a half-updated bitmap.
+	if first.AggregateSignature.Bitmap[0] != 0x01 {
+		t.Errorf("original first.Bitmap = %x, want unchanged %x", first.AggregateSignature.Bitmap, byte(0x01))
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 Factom Foundation
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package messages
+
+import "fmt"
+
+// ErrTruncated is returned when an Unmarshal call runs out of input before
+// it finished reading a fixed-size field, modeled on the numbered error
+// codes used by the transition tools rather than letting a slice index
+// panic do the talking.
+type ErrTruncated struct {
+	Where string
+	Need  int
+	Have  int
+}
+
+func (e *ErrTruncated) Error() string {
+	return fmt.Sprintf("%s: truncated input, need at least %d bytes, have %d", e.Where, e.Need, e.Have)
+}
+
+// ErrInvalidMinute is returned when a minute field is outside the valid
+// [0,9] range for an end-of-minute message.
+type ErrInvalidMinute struct {
+	Minute byte
+}
+
+func (e *ErrInvalidMinute) Error() string {
+	return fmt.Sprintf("invalid minute %d, must be in [0,9]", e.Minute)
+}
+
+// ErrBadSignature is returned when a message carries a signature that was
+// actually checked against its expected bytes/keys and failed. It means the
+// message is provably malformed and safe to discard.
+type ErrBadSignature struct {
+	Reason string
+}
+
+func (e *ErrBadSignature) Error() string {
+	return fmt.Sprintf("bad signature: %s", e.Reason)
+}
+
+// ErrUnverifiable is returned when a message's validity could not be
+// determined, as opposed to having been determined invalid: no signature is
+// present yet (e.g. a locally-constructed, not-yet-signed message), or the
+// infrastructure needed to check one (an authority key provider) isn't
+// available yet. Callers should treat this as "try again later", not
+// "malformed" -- unlike ErrBadSignature, nothing here has actually failed a
+// check.
+type ErrUnverifiable struct {
+	Reason string
+}
+
+func (e *ErrUnverifiable) Error() string {
+	return fmt.Sprintf("cannot verify yet: %s", e.Reason)
+}
+
+// ErrUnknownType is returned when a message's type byte doesn't match any
+// type this build of factomd understands.
+type ErrUnknownType struct {
+	Type int
+}
+
+func (e *ErrUnknownType) Error() string {
+	return fmt.Sprintf("unknown message type %d", e.Type)
+}
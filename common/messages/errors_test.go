@@ -0,0 +1,43 @@
+// Copyright 2015 Factom Foundation
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package messages
+
+import "testing"
+
+func TestErrorMessages(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"ErrTruncated", &ErrTruncated{Where: "EOM.Minute", Need: 1, Have: 0}, "EOM.Minute: truncated input, need at least 1 bytes, have 0"},
+		{"ErrInvalidMinute", &ErrInvalidMinute{Minute: 12}, "invalid minute 12, must be in [0,9]"},
+		{"ErrBadSignature", &ErrBadSignature{Reason: "signature does not verify"}, "bad signature: signature does not verify"},
+		{"ErrUnverifiable", &ErrUnverifiable{Reason: "no authority key provider installed"}, "cannot verify yet: no authority key provider installed"},
+		{"ErrUnknownType", &ErrUnknownType{Type: 42}, "unknown message type 42"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.err.Error(); got != c.want {
+				t.Errorf("Error() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestEOMUnmarshalUnknownType(t *testing.T) {
+	// First byte is a type marker that isn't constants.EOM_MSG; not a valid
+	// CanonV2 marker either, so UnmarshalBinaryData reads it as the legacy
+	// type byte and should reject it as ErrUnknownType rather than silently
+	// parsing the rest of the message as an EOM.
+	data := []byte{0xAB}
+
+	m := new(EOM)
+	_, err := m.UnmarshalBinaryData(data)
+	if _, ok := err.(*ErrUnknownType); !ok {
+		t.Fatalf("UnmarshalBinaryData with a bad type byte: got %#v, want *ErrUnknownType", err)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2015 Factom Foundation
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package messages
+
+import (
+	"sync"
+	"time"
+
+	"github.com/FactomProject/factomd/common/interfaces"
+)
+
+// EventFilter narrows an EventFeed subscription down to the events a client
+// actually cares about. A zero-valued field means "don't filter on this
+// dimension", so the zero-valued EventFilter{} matches everything. Borrowed
+// from eth/filters' FilterCriteria: block explorers and wallet watchers want
+// "minute 9 events for block N..M" rather than every EOM on the wire.
+type EventFilter struct {
+	Minute             *int // nil means any minute
+	FromDirectoryBlock uint32
+	ToDirectoryBlock   uint32           // 0 means no upper bound
+	IdentityChainID    interfaces.IHash // nil means any identity
+}
+
+func (f *EventFilter) matches(msg Signable) bool {
+	switch m := msg.(type) {
+	case *EOM:
+		if f.Minute != nil && int(m.Minute) != *f.Minute {
+			return false
+		}
+		return f.matchesHeightAndIdentity(m.DirectoryBlockHeight, m.IdentityChainID)
+	case *DirectoryBlockSignature:
+		// A DirectoryBlockSignature carries no height or identity of its
+		// own: the height range does not apply to it, and an
+		// IdentityChainID filter never matches it.
+		return f.IdentityChainID == nil
+	default:
+		return false
+	}
+}
+
+func (f *EventFilter) matchesHeightAndIdentity(height uint32, identityChainID interfaces.IHash) bool {
+	if f.FromDirectoryBlock != 0 && height < f.FromDirectoryBlock {
+		return false
+	}
+	if f.ToDirectoryBlock != 0 && height > f.ToDirectoryBlock {
+		return false
+	}
+	if f.IdentityChainID != nil && (identityChainID == nil || !f.IdentityChainID.IsSameAs(identityChainID)) {
+		return false
+	}
+	return true
+}
+
+// eventFeedBuffer bounds how many undelivered events a single subscriber can
+// accumulate before it starts being dropped; a slow or abandoned subscriber
+// must not be able to grow memory without bound.
+const eventFeedBuffer = 256
+
+// subscriptionTimeout is how long a subscription may go without Events being
+// drained before the sweep considers it abandoned.
+const subscriptionTimeout = 10 * time.Minute
+
+type eventSubscription struct {
+	id       uint64
+	filter   EventFilter
+	events   chan Signable
+	lastRead time.Time
+	mu       sync.Mutex
+}
+
+// Events returns the channel new matching messages are delivered on.
+// Callers should call Touch each time they read from it, or the abandoned-
+// subscription sweep will eventually uninstall it regardless of whether
+// it's still in use.
+func (s *eventSubscription) Events() <-chan Signable {
+	return s.events
+}
+
+// Touch marks the subscription as recently read, resetting its idle timer.
+func (s *eventSubscription) Touch() {
+	s.mu.Lock()
+	s.lastRead = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *eventSubscription) idle() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastRead)
+}
+
+// EventFeed fans EOM and DirectoryBlockSignature messages out to subscribers
+// filtered by minute, directory block height range, or identity chain ID,
+// so JSON-RPC/WebSocket clients can watch minute boundaries without polling.
+type EventFeed struct {
+	mu          sync.Mutex
+	nextID      uint64
+	subscribers map[uint64]*eventSubscription
+	unsubscribe func()
+
+	sweepOnce sync.Once
+	stop      chan struct{}
+}
+
+// NewEventFeed creates an EventFeed subscribed to TopicEOM and
+// TopicDirectoryBlockSignature on broadcaster, and starts its abandoned-
+// subscription sweep. Callers should keep it around for the life of the
+// node and call Close on shutdown.
+func NewEventFeed(broadcaster Broadcaster) *EventFeed {
+	feed := &EventFeed{
+		subscribers: make(map[uint64]*eventSubscription),
+		stop:        make(chan struct{}),
+	}
+
+	unsubEOM := broadcaster.Subscribe(TopicEOM, feed.deliver)
+	unsubDBS := broadcaster.Subscribe(TopicDirectoryBlockSignature, feed.deliver)
+	feed.unsubscribe = func() {
+		unsubEOM()
+		unsubDBS()
+	}
+
+	go feed.sweepAbandoned()
+
+	return feed
+}
+
+func (f *EventFeed) deliver(msg Signable) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, sub := range f.subscribers {
+		if !sub.filter.matches(msg) {
+			continue
+		}
+		select {
+		case sub.events <- msg:
+		default:
+			// Subscriber isn't keeping up; drop rather than block the
+			// publisher or unbounded-buffer the backlog.
+		}
+	}
+}
+
+// Subscribe installs filter and returns a subscription whose Events channel
+// receives every future matching EOM/DirectoryBlockSignature.
+func (f *EventFeed) Subscribe(filter EventFilter) *eventSubscription {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nextID++
+	sub := &eventSubscription{
+		id:       f.nextID,
+		filter:   filter,
+		events:   make(chan Signable, eventFeedBuffer),
+		lastRead: time.Now(),
+	}
+	f.subscribers[sub.id] = sub
+	return sub
+}
+
+// UninstallFilter removes a subscription, closing its Events channel.
+func (f *EventFeed) UninstallFilter(sub *eventSubscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removeLocked(sub.id)
+}
+
+func (f *EventFeed) removeLocked(id uint64) {
+	if sub, ok := f.subscribers[id]; ok {
+		close(sub.events)
+		delete(f.subscribers, id)
+	}
+}
+
+// sweepAbandoned periodically removes subscriptions nobody has drained in
+// subscriptionTimeout, so a client that disappears without calling
+// UninstallFilter doesn't leak a goroutine's worth of buffered channel
+// forever.
+func (f *EventFeed) sweepAbandoned() {
+	ticker := time.NewTicker(subscriptionTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			f.mu.Lock()
+			for id, sub := range f.subscribers {
+				if sub.idle() > subscriptionTimeout {
+					f.removeLocked(id)
+				}
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+// Close stops the sweep and unsubscribes the feed from its Broadcaster.
+func (f *EventFeed) Close() {
+	f.sweepOnce.Do(func() {
+		close(f.stop)
+		f.unsubscribe()
+	})
+}
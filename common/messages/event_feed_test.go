@@ -0,0 +1,50 @@
+// Copyright 2015 Factom Foundation
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package messages
+
+import "testing"
+
+func TestEventFilterZeroValueMatchesEveryMinute(t *testing.T) {
+	var filter EventFilter
+
+	for minute := byte(0); minute < 10; minute++ {
+		eom := &EOM{Minute: minute}
+		if !filter.matches(eom) {
+			t.Errorf("zero-value EventFilter should match minute %d, didn't", minute)
+		}
+	}
+}
+
+func TestEventFilterMinuteFilter(t *testing.T) {
+	wanted := 9
+	filter := EventFilter{Minute: &wanted}
+
+	if !filter.matches(&EOM{Minute: 9}) {
+		t.Error("filter for minute 9 should match a minute-9 EOM")
+	}
+	if filter.matches(&EOM{Minute: 3}) {
+		t.Error("filter for minute 9 should not match a minute-3 EOM")
+	}
+}
+
+func TestEventFilterDirectoryBlockRange(t *testing.T) {
+	filter := EventFilter{FromDirectoryBlock: 10, ToDirectoryBlock: 20}
+
+	cases := map[uint32]bool{9: false, 10: true, 15: true, 20: true, 21: false}
+	for height, want := range cases {
+		got := filter.matches(&EOM{DirectoryBlockHeight: height})
+		if got != want {
+			t.Errorf("height %d: matches() = %v, want %v", height, got, want)
+		}
+	}
+}
+
+func TestEventFilterMatchesDirectoryBlockSignature(t *testing.T) {
+	filter := EventFilter{FromDirectoryBlock: 10}
+
+	if !filter.matches(&DirectoryBlockSignature{}) {
+		t.Error("DirectoryBlockSignature carries no height/identity of its own, so a height-only filter should still match it")
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 Factom Foundation
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package primitives
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	bls "github.com/herumi/bls-eth-go-binary/bls"
+)
+
+func init() {
+	// herumi's binding requires picking a curve before any Sign/PublicKey
+	// method is used; every process linking this package needs this done
+	// exactly once, so it happens here rather than asking every caller to
+	// remember it.
+	if err := bls.Init(bls.BLS12_381); err != nil {
+		panic(fmt.Sprintf("bls12-381 initialization failed: %s", err))
+	}
+}
+
+// AggregateSignatureLength is the byte length of a BLS12-381 G2 signature
+// point in compressed (serialized) form.
+const AggregateSignatureLength = 96
+
+// AggregateSignature is a BLS aggregate over a bitmap of participating
+// identity chain IDs. It lets N authority servers attest the same minute
+// boundary with a single 96-byte signature instead of one network message
+// per signer.
+//
+// Bitmap is indexed by each signer's position in the network's current
+// authority list (not by IdentityChainID directly), so the wire size stays
+// proportional to the authority set rather than to the full chain ID space.
+type AggregateSignature struct {
+	Bitmap    []byte
+	Signature [AggregateSignatureLength]byte
+}
+
+// BLSPublicKey wraps the underlying curve library's public key type so
+// callers outside this package never need to import it directly, the same
+// way Signature wraps this package's other signing schemes.
+type BLSPublicKey struct {
+	key *bls.PublicKey
+}
+
+func NewBLSPublicKey(key *bls.PublicKey) *BLSPublicKey {
+	return &BLSPublicKey{key: key}
+}
+
+func NewAggregateSignature(authorityCount int) *AggregateSignature {
+	return &AggregateSignature{
+		Bitmap: make([]byte, (authorityCount+7)/8),
+	}
+}
+
+// Add folds pubkey/sig in at authority index idx into the aggregate. An idx
+// that is already set is rejected with an error, since adding the same
+// signer twice would double-count its signature in the aggregate.
+func (a *AggregateSignature) Add(idx int, pubkey *BLSPublicKey, sig *bls.Sign) error {
+	byteIdx, bitIdx := idx/8, uint(idx%8)
+	if byteIdx >= len(a.Bitmap) {
+		return fmt.Errorf("authority index %d out of range for bitmap of %d bytes", idx, len(a.Bitmap))
+	}
+	if a.Bitmap[byteIdx]&(1<<bitIdx) != 0 {
+		return fmt.Errorf("authority index %d already aggregated", idx)
+	}
+
+	agg := *sig
+	if !a.isEmpty() {
+		var existing bls.Sign
+		if err := existing.Deserialize(a.Signature[:]); err != nil {
+			return err
+		}
+		existing.Add(&agg)
+		agg = existing
+	}
+
+	copy(a.Signature[:], agg.Serialize())
+	a.Bitmap[byteIdx] |= 1 << bitIdx
+	return nil
+}
+
+func (a *AggregateSignature) isEmpty() bool {
+	for _, b := range a.Bitmap {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyAggregate checks the aggregate signature against msg using exactly
+// the public keys of the signers marked in Bitmap, in authority order. Every
+// signer in an AggregateSignature attests the same message (the EOM's
+// signed bytes), so this is a FastAggregateVerify, not the more general
+// (and more expensive) distinct-message aggregate verify.
+func (a *AggregateSignature) VerifyAggregate(pubkeys []*BLSPublicKey, msg []byte) (bool, error) {
+	var signers []bls.PublicKey
+	for i, pk := range pubkeys {
+		byteIdx, bitIdx := i/8, uint(i%8)
+		if byteIdx >= len(a.Bitmap) {
+			break
+		}
+		if a.Bitmap[byteIdx]&(1<<bitIdx) != 0 {
+			signers = append(signers, *pk.key)
+		}
+	}
+	if len(signers) == 0 {
+		return false, fmt.Errorf("aggregate signature has no participating signers")
+	}
+
+	var sig bls.Sign
+	if err := sig.Deserialize(a.Signature[:]); err != nil {
+		return false, err
+	}
+	return sig.FastAggregateVerify(signers, msg), nil
+}
+
+// Merge folds other's signers into a, provided the two bitmaps don't
+// overlap; an overlapping signer would be counted twice in the resulting
+// aggregate, which would make it unverifiable.
+func (a *AggregateSignature) Merge(other *AggregateSignature) error {
+	if other == nil || other.isEmpty() {
+		return nil
+	}
+	if len(a.Bitmap) != len(other.Bitmap) {
+		return fmt.Errorf("cannot merge aggregate signatures over different authority set sizes")
+	}
+	for i := range a.Bitmap {
+		if a.Bitmap[i]&other.Bitmap[i] != 0 {
+			return fmt.Errorf("aggregate signatures overlap on at least one signer")
+		}
+	}
+	if a.isEmpty() {
+		a.Bitmap = append([]byte(nil), other.Bitmap...)
+		a.Signature = other.Signature
+		return nil
+	}
+
+	var mine, theirs bls.Sign
+	if err := mine.Deserialize(a.Signature[:]); err != nil {
+		return err
+	}
+	if err := theirs.Deserialize(other.Signature[:]); err != nil {
+		return err
+	}
+	mine.Add(&theirs)
+	copy(a.Signature[:], mine.Serialize())
+
+	for i := range a.Bitmap {
+		a.Bitmap[i] |= other.Bitmap[i]
+	}
+	return nil
+}
+
+// MarshalBinary encodes the bitmap length, bitmap, and the 96-byte
+// aggregate signature.
+func (a *AggregateSignature) MarshalBinary() ([]byte, error) {
+	var out []byte
+	lenBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(lenBytes, uint32(len(a.Bitmap)))
+	out = append(out, lenBytes...)
+	out = append(out, a.Bitmap...)
+	out = append(out, a.Signature[:]...)
+	return out, nil
+}
+
+// UnmarshalBinaryData round-trips the encoding produced by MarshalBinary.
+func (a *AggregateSignature) UnmarshalBinaryData(data []byte) (newData []byte, err error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("aggregate signature: not enough data for bitmap length")
+	}
+	bitmapLen := int(binary.BigEndian.Uint32(data[:4]))
+	data = data[4:]
+
+	if len(data) < bitmapLen+AggregateSignatureLength {
+		return nil, fmt.Errorf("aggregate signature: not enough data for bitmap and signature")
+	}
+
+	a.Bitmap = append([]byte(nil), data[:bitmapLen]...)
+	data = data[bitmapLen:]
+	copy(a.Signature[:], data[:AggregateSignatureLength])
+	return data[AggregateSignatureLength:], nil
+}
+
+func (a *AggregateSignature) UnmarshalBinary(data []byte) error {
+	_, err := a.UnmarshalBinaryData(data)
+	return err
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 Factom Foundation
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package primitives
+
+import (
+	"testing"
+
+	bls "github.com/herumi/bls-eth-go-binary/bls"
+)
+
+func TestAggregateSignatureMergeRejectsOverlap(t *testing.T) {
+	a := &AggregateSignature{Bitmap: []byte{0x01}}
+	b := &AggregateSignature{Bitmap: []byte{0x01}}
+
+	if err := a.Merge(b); err == nil {
+		t.Fatal("Merge should reject two aggregates that both have signer 0 set")
+	}
+}
+
+func TestAggregateSignatureMergeRejectsMismatchedAuthoritySetSize(t *testing.T) {
+	a := &AggregateSignature{Bitmap: []byte{0x01}}
+	b := &AggregateSignature{Bitmap: []byte{0x00, 0x00}}
+
+	if err := a.Merge(b); err == nil {
+		t.Fatal("Merge should reject aggregates built over different authority set sizes")
+	}
+}
+
+func TestAggregateSignatureMergeIntoEmpty(t *testing.T) {
+	a := NewAggregateSignature(8)
+	b := &AggregateSignature{Bitmap: []byte{0x02}, Signature: [AggregateSignatureLength]byte{1, 2, 3}}
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge into an empty aggregate should succeed, got %v", err)
+	}
+	if a.Bitmap[0] != 0x02 {
+		t.Errorf("Bitmap = %x, want %x", a.Bitmap, b.Bitmap)
+	}
+	if a.Signature != b.Signature {
+		t.Errorf("Signature = %x, want %x", a.Signature, b.Signature)
+	}
+}
+
+func TestAggregateSignatureMergeNilOrEmptyOtherIsNoop(t *testing.T) {
+	a := &AggregateSignature{Bitmap: []byte{0x01}, Signature: [AggregateSignatureLength]byte{9}}
+
+	if err := a.Merge(nil); err != nil {
+		t.Fatalf("Merge(nil) should be a no-op, got error %v", err)
+	}
+	if err := a.Merge(&AggregateSignature{Bitmap: []byte{0x01}}); err != nil {
+		t.Fatalf("Merge of an empty aggregate should be a no-op, got error %v", err)
+	}
+	if a.Bitmap[0] != 0x01 || a.Signature[0] != 9 {
+		t.Error("Merge of a nil/empty aggregate should not modify the receiver")
+	}
+}
+
+func TestAggregateSignatureAddOutOfRangeIndex(t *testing.T) {
+	a := NewAggregateSignature(8)
+	if err := a.Add(8, nil, nil); err == nil {
+		t.Fatal("Add with an index past the bitmap should be rejected")
+	}
+}
+
+// TestAggregateSignatureVerifyRoundTrip exercises the real bls-eth-go-binary
+// integration end to end: genuine keypairs, genuine signatures, Add-ed into
+// an aggregate and checked with VerifyAggregate. The tests above never reach
+// Deserialize/FastAggregateVerify, so without this a regression there (e.g.
+// swapped FastAggregateVerify arguments) would pass unnoticed.
+func TestAggregateSignatureVerifyRoundTrip(t *testing.T) {
+	var sk0, sk1 bls.SecretKey
+	sk0.SetByCSPRNG()
+	sk1.SetByCSPRNG()
+	pk0, pk1 := sk0.GetPublicKey(), sk1.GetPublicKey()
+
+	msg := []byte("minute 9 end-of-minute")
+	sig0 := sk0.SignByte(msg)
+	sig1 := sk1.SignByte(msg)
+
+	agg := NewAggregateSignature(2)
+	if err := agg.Add(0, NewBLSPublicKey(pk0), sig0); err != nil {
+		t.Fatalf("Add(0): %v", err)
+	}
+	if err := agg.Add(1, NewBLSPublicKey(pk1), sig1); err != nil {
+		t.Fatalf("Add(1): %v", err)
+	}
+
+	pubkeys := []*BLSPublicKey{NewBLSPublicKey(pk0), NewBLSPublicKey(pk1)}
+
+	ok, err := agg.VerifyAggregate(pubkeys, msg)
+	if err != nil {
+		t.Fatalf("VerifyAggregate: %v", err)
+	}
+	if !ok {
+		t.Error("VerifyAggregate should accept a genuine aggregate over the signed message")
+	}
+
+	ok, err = agg.VerifyAggregate(pubkeys, []byte("a different message"))
+	if err != nil {
+		t.Fatalf("VerifyAggregate against a tampered message: %v", err)
+	}
+	if ok {
+		t.Error("VerifyAggregate should reject the aggregate against a message it didn't sign")
+	}
+
+	var sk2 bls.SecretKey
+	sk2.SetByCSPRNG()
+	wrongPubkeys := []*BLSPublicKey{NewBLSPublicKey(sk2.GetPublicKey()), NewBLSPublicKey(pk1)}
+	ok, err = agg.VerifyAggregate(wrongPubkeys, msg)
+	if err != nil {
+		t.Fatalf("VerifyAggregate against the wrong signer key: %v", err)
+	}
+	if ok {
+		t.Error("VerifyAggregate should reject when checked against the wrong signer's public key")
+	}
+}